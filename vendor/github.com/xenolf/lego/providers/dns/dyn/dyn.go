@@ -6,16 +6,44 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/xenolf/lego/acme"
+	"github.com/xenolf/lego/log"
 	"github.com/xenolf/lego/platform/config/env"
 )
 
 var dynBaseURL = "https://api.dynect.net/REST"
 
+const (
+	// jobPollInitialInterval is the delay before the first poll of a long
+	// running Dyn job.
+	jobPollInitialInterval = 1 * time.Second
+	// jobPollMaxInterval caps the exponential backoff between polls.
+	jobPollMaxInterval = 30 * time.Second
+
+	defaultTTL                = 30
+	defaultPropagationTimeout = 60 * time.Second
+	defaultPollingInterval    = 2 * time.Second
+	defaultHTTPTimeout        = 10 * time.Second
+	// defaultJobPollTimeout is the overall deadline for a job to reach a
+	// terminal state, used when Config.JobPollTimeout is zero.
+	defaultJobPollTimeout = 2 * time.Minute
+
+	// publishDebounceWindow is how long a pending zone waits before the
+	// debounce timer publishes it, if no Commit has published it first. The
+	// timer is started by schedulePublish and restarted for zones whose
+	// publish failed, so a transient publish failure isn't silently dropped.
+	// Present/CleanUp call Commit right after scheduling, so for them the
+	// timer only matters after a failure.
+	publishDebounceWindow = 2 * time.Second
+)
+
 type dynResponse struct {
 	// One of 'success', 'failure', or 'incomplete'
 	Status string `json:"status"`
@@ -30,14 +58,87 @@ type dynResponse struct {
 	Messages json.RawMessage `json:"msgs"`
 }
 
+// Config is used to configure the creation of the DNSProvider.
+type Config struct {
+	CustomerName       string
+	UserName           string
+	Password           string
+	TTL                int
+	PropagationTimeout time.Duration
+	PollingInterval    time.Duration
+
+	// HTTPTimeout sets the timeout of HTTPClient, if HTTPClient is left nil,
+	// or overrides a caller-supplied HTTPClient's Timeout if it's non-zero.
+	// This is the one knob that always applies, regardless of how HTTPClient
+	// was constructed.
+	HTTPTimeout time.Duration
+	HTTPClient  *http.Client
+
+	// JobPollTimeout bounds how long pollJob waits for an async Dyn job
+	// (HTTP 307 / "incomplete") to reach a terminal state. There is no
+	// context.Context threaded through this provider - acme.ChallengeProvider
+	// doesn't accept one - so this overall deadline is the only cancellation
+	// mechanism for a stuck job.
+	JobPollTimeout time.Duration
+
+	// Trace, when set, is called with the raw details of every Dyn API
+	// exchange made through doRequest; the DELETE /Session sent by logout
+	// is not traced. Dyn's Messages field is opaque JSON, so this is the
+	// escape hatch for debugging without recompiling.
+	Trace func(method, url string, status int, body []byte)
+}
+
+// NewDefaultConfig returns a default configuration for the DNSProvider,
+// filled in from the DYN_TTL, DYN_PROPAGATION_TIMEOUT, DYN_POLLING_INTERVAL,
+// DYN_HTTP_TIMEOUT and DYN_JOB_POLL_TIMEOUT environment variables when present.
+func NewDefaultConfig() *Config {
+	httpTimeout := env.GetOrDefaultSecond("DYN_HTTP_TIMEOUT", defaultHTTPTimeout)
+
+	client := &http.Client{Timeout: httpTimeout}
+	preventRedirectFollowing(client)
+
+	return &Config{
+		TTL:                env.GetOrDefaultInt("DYN_TTL", defaultTTL),
+		PropagationTimeout: env.GetOrDefaultSecond("DYN_PROPAGATION_TIMEOUT", defaultPropagationTimeout),
+		PollingInterval:    env.GetOrDefaultSecond("DYN_POLLING_INTERVAL", defaultPollingInterval),
+		JobPollTimeout:     env.GetOrDefaultSecond("DYN_JOB_POLL_TIMEOUT", defaultJobPollTimeout),
+		HTTPTimeout:        httpTimeout,
+		HTTPClient:         client,
+	}
+}
+
+// preventRedirectFollowing stops client from transparently re-issuing the
+// original request against a 307/308 Location, which would otherwise hide
+// Dyn's "job started, poll for completion" responses from sendRequest.
+func preventRedirectFollowing(client *http.Client) {
+	if client.CheckRedirect == nil {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+}
+
+// Record pairs a domain with the keyAuth used to compute its DNS-01 TXT
+// record, for use with PresentAll and CleanUpAll.
+type Record struct {
+	Domain  string
+	KeyAuth string
+}
+
 // DNSProvider is an implementation of the acme.ChallengeProvider interface that uses
 // Dyn's Managed DNS API to manage TXT records for a domain.
 type DNSProvider struct {
-	customerName string
-	userName     string
-	password     string
-	token        string
-	client       *http.Client
+	config *Config
+
+	tokenMu sync.RWMutex
+	token   string
+
+	sessionMu sync.Mutex // serializes login attempts so concurrent calls share one session
+
+	pendingMu    sync.Mutex
+	pendingZones map[string]struct{}
+	flushTimer   *time.Timer
+	flushErrs    map[string]error // per zone, populated by a failed deferred flush
 }
 
 // NewDNSProvider returns a DNSProvider instance configured for Dyn DNS.
@@ -49,70 +150,261 @@ func NewDNSProvider() (*DNSProvider, error) {
 		return nil, fmt.Errorf("DynDNS: %v", err)
 	}
 
-	return NewDNSProviderCredentials(values["DYN_CUSTOMER_NAME"], values["DYN_USER_NAME"], values["DYN_PASSWORD"])
+	config := NewDefaultConfig()
+	config.CustomerName = values["DYN_CUSTOMER_NAME"]
+	config.UserName = values["DYN_USER_NAME"]
+	config.Password = values["DYN_PASSWORD"]
+
+	return NewDNSProviderConfig(config)
 }
 
 // NewDNSProviderCredentials uses the supplied credentials to return a
 // DNSProvider instance configured for Dyn DNS.
+//
+// Deprecated: use NewDNSProviderConfig instead.
 func NewDNSProviderCredentials(customerName, userName, password string) (*DNSProvider, error) {
-	if customerName == "" || userName == "" || password == "" {
+	config := NewDefaultConfig()
+	config.CustomerName = customerName
+	config.UserName = userName
+	config.Password = password
+
+	return NewDNSProviderConfig(config)
+}
+
+// NewDNSProviderConfig returns a DNSProvider instance configured with the
+// supplied Config.
+func NewDNSProviderConfig(config *Config) (*DNSProvider, error) {
+	if config == nil {
+		return nil, fmt.Errorf("DynDNS: the configuration of the DNS provider is nil")
+	}
+
+	if config.CustomerName == "" || config.UserName == "" || config.Password == "" {
 		return nil, fmt.Errorf("DynDNS credentials missing")
 	}
 
-	return &DNSProvider{
-		customerName: customerName,
-		userName:     userName,
-		password:     password,
-		client:       &http.Client{Timeout: 10 * time.Second},
-	}, nil
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{}
+	}
+	switch {
+	case config.HTTPTimeout != 0:
+		// HTTPTimeout is the authoritative knob: apply it even to a
+		// caller-supplied HTTPClient, so it isn't only honored when
+		// NewDefaultConfig happens to be the one building the client.
+		config.HTTPClient.Timeout = config.HTTPTimeout
+	case config.HTTPClient.Timeout == 0:
+		config.HTTPClient.Timeout = defaultHTTPTimeout
+	}
+	preventRedirectFollowing(config.HTTPClient)
+
+	if config.JobPollTimeout == 0 {
+		config.JobPollTimeout = defaultJobPollTimeout
+	}
+
+	return &DNSProvider{config: config}, nil
+}
+
+// Timeout returns the timeout and interval to use when checking for DNS
+// propagation, allowing callers to override the defaults via Config.
+func (d *DNSProvider) Timeout() (timeout, interval time.Duration) {
+	return d.config.PropagationTimeout, d.config.PollingInterval
 }
 
 func (d *DNSProvider) sendRequest(method, resource string, payload interface{}) (*dynResponse, error) {
+	resp, dynRes, err := d.requestWithReauth(method, resource, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTemporaryRedirect || dynRes.Status == "incomplete" {
+		jobID := dynRes.JobID
+		if jobID == 0 {
+			jobID, err = parseJobID(resp.Header.Get("Location"))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return d.pollJob(jobID)
+	}
+
+	if dynRes.Status == "failure" {
+		// TODO add better error handling
+		return nil, fmt.Errorf("Dyn API request failed: %s", dynRes.Messages)
+	}
+
+	return dynRes, nil
+}
+
+// doRequest performs a single HTTP round trip against the Dyn API and
+// decodes the envelope, without following up on 307/incomplete responses.
+func (d *DNSProvider) doRequest(method, resource string, payload interface{}) (*http.Response, *dynResponse, error) {
 	url := fmt.Sprintf("%s/%s", dynBaseURL, resource)
 
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	req, err := http.NewRequest(method, url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	if len(d.token) > 0 {
-		req.Header.Set("Auth-Token", d.token)
+	if token := d.getToken(); token != "" {
+		req.Header.Set("Auth-Token", token)
 	}
 
-	resp, err := d.client.Do(req)
+	resp, err := d.config.HTTPClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
+	rawBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d.config.Trace != nil {
+		d.config.Trace(method, url, resp.StatusCode, rawBody)
+	}
+
 	if resp.StatusCode >= 500 {
-		return nil, fmt.Errorf("Dyn API request failed with HTTP status code %d", resp.StatusCode)
+		return nil, nil, fmt.Errorf("Dyn API request failed with HTTP status code %d", resp.StatusCode)
 	}
 
 	var dynRes dynResponse
-	err = json.NewDecoder(resp.Body).Decode(&dynRes)
+	if err := json.Unmarshal(rawBody, &dynRes); err != nil {
+		return nil, nil, err
+	}
+
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusUnauthorized {
+		return nil, nil, fmt.Errorf("Dyn API request failed with HTTP status code %d: %s", resp.StatusCode, dynRes.Messages)
+	}
+
+	return resp, &dynRes, nil
+}
+
+// requestWithReauth performs a doRequest round trip, retrying exactly once
+// after a fresh login if the cached session token was rejected with HTTP
+// 401. A 401 that persists after re-authenticating (bad credentials after
+// rotation, a suspended account, a zone that belongs to another customer,
+// ...) is a hard failure regardless of what the decoded body says.
+func (d *DNSProvider) requestWithReauth(method, resource string, payload interface{}) (*http.Response, *dynResponse, error) {
+	resp, dynRes, err := d.doRequest(method, resource, payload)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("Dyn API request failed with HTTP status code %d: %s", resp.StatusCode, dynRes.Messages)
-	} else if resp.StatusCode == 307 {
-		// TODO add support for HTTP 307 response and long running jobs
-		return nil, fmt.Errorf("Dyn API request returned HTTP 307. This is currently unsupported")
+	if resp.StatusCode == http.StatusUnauthorized {
+		log.Warnf("dyn: session token rejected with HTTP 401, re-authenticating")
+		d.setToken("")
+		if err := d.ensureSession(); err != nil {
+			return nil, nil, err
+		}
+
+		resp, dynRes, err = d.doRequest(method, resource, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, nil, fmt.Errorf("Dyn API request failed: still unauthorized after re-authenticating")
+		}
 	}
 
-	if dynRes.Status == "failure" {
-		// TODO add better error handling
-		return nil, fmt.Errorf("Dyn API request failed: %s", dynRes.Messages)
+	return resp, dynRes, nil
+}
+
+func (d *DNSProvider) getToken() string {
+	d.tokenMu.RLock()
+	defer d.tokenMu.RUnlock()
+	return d.token
+}
+
+func (d *DNSProvider) setToken(token string) {
+	d.tokenMu.Lock()
+	defer d.tokenMu.Unlock()
+	d.token = token
+}
+
+// ensureSession makes sure the provider holds a valid session token,
+// authenticating only if no cached token is available. Concurrent callers
+// share the same session instead of each performing their own login.
+func (d *DNSProvider) ensureSession() error {
+	if d.getToken() != "" {
+		return nil
 	}
 
-	return &dynRes, nil
+	d.sessionMu.Lock()
+	defer d.sessionMu.Unlock()
+
+	if d.getToken() != "" {
+		// another goroutine logged in while we were waiting for the lock
+		return nil
+	}
+
+	return d.login()
+}
+
+// pollJob waits for a long running Dyn job (returned as HTTP 307 or an
+// "incomplete" status) to reach a terminal state, using an exponential
+// backoff between polls. Each poll goes through requestWithReauth, since a
+// multi-minute job can easily outlive the session token that started it.
+// pollJob is bounded only by d.config.JobPollTimeout; there is no
+// context.Context to cancel it early because acme.ChallengeProvider's
+// Present/CleanUp methods don't accept one.
+func (d *DNSProvider) pollJob(jobID int) (*dynResponse, error) {
+	log.Infof("dyn: waiting for job %d to complete", jobID)
+
+	resource := fmt.Sprintf("Job/%d", jobID)
+	timeout := d.config.JobPollTimeout
+	if timeout == 0 {
+		timeout = defaultJobPollTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	interval := jobPollInitialInterval
+
+	for {
+		_, dynRes, err := d.requestWithReauth(http.MethodGet, resource, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		switch dynRes.Status {
+		case "success":
+			return dynRes, nil
+		case "failure":
+			return nil, fmt.Errorf("Dyn API job %d failed: %s", jobID, dynRes.Messages)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Dyn API job %d did not complete within %s", jobID, timeout)
+		}
+
+		time.Sleep(interval)
+
+		interval *= 2
+		if interval > jobPollMaxInterval {
+			interval = jobPollMaxInterval
+		}
+	}
+}
+
+// parseJobID extracts the job ID from a Job resource Location header such
+// as "/REST/Job/123456789".
+func parseJobID(location string) (int, error) {
+	if location == "" {
+		return 0, fmt.Errorf("Dyn API returned HTTP 307 without a usable Location header")
+	}
+
+	parts := strings.Split(strings.TrimRight(location, "/"), "/")
+	jobID, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return 0, fmt.Errorf("Dyn API returned an unparsable job ID in Location header %q: %v", location, err)
+	}
+
+	return jobID, nil
 }
 
 // Starts a new Dyn API Session. Authenticates using customerName, userName,
@@ -129,26 +421,45 @@ func (d *DNSProvider) login() error {
 		Version string `json:"version"`
 	}
 
-	payload := &creds{Customer: d.customerName, User: d.userName, Pass: d.password}
-	dynRes, err := d.sendRequest(http.MethodPost, "Session", payload)
+	// doRequest is used directly here (rather than sendRequest) so that a
+	// login failure can't recurse back into ensureSession and deadlock on
+	// sessionMu.
+	payload := &creds{Customer: d.config.CustomerName, User: d.config.UserName, Pass: d.config.Password}
+	_, dynRes, err := d.doRequest(http.MethodPost, "Session", payload)
 	if err != nil {
 		return err
 	}
 
+	if dynRes.Status == "failure" {
+		return fmt.Errorf("Dyn API login failed: %s", dynRes.Messages)
+	}
+
 	var s session
 	err = json.Unmarshal(dynRes.Data, &s)
 	if err != nil {
 		return err
 	}
 
-	d.token = s.Token
+	d.setToken(s.Token)
+
+	log.Infof("dyn: logged in, session established")
 
 	return nil
 }
 
+// Close ends the cached Dyn session, if one is open. CleanUp and CleanUpAll
+// already call this once they're done, since a DNS-01 challenge flow always
+// ends with a cleanup; it's exported so a caller that only ever calls
+// Present (e.g. validation failed before cleanup ran) can still free the
+// session explicitly.
+func (d *DNSProvider) Close() error {
+	return d.logout()
+}
+
 // Destroys Dyn Session
 func (d *DNSProvider) logout() error {
-	if len(d.token) == 0 {
+	token := d.getToken()
+	if token == "" {
 		// nothing to do
 		return nil
 	}
@@ -159,9 +470,9 @@ func (d *DNSProvider) logout() error {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Auth-Token", d.token)
+	req.Header.Set("Auth-Token", token)
 
-	resp, err := d.client.Do(req)
+	resp, err := d.config.HTTPClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -171,22 +482,36 @@ func (d *DNSProvider) logout() error {
 		return fmt.Errorf("Dyn API request failed to delete session with HTTP status code %d", resp.StatusCode)
 	}
 
-	d.token = ""
+	d.setToken("")
+
+	log.Infof("dyn: session closed")
 
 	return nil
 }
 
-// Present creates a TXT record using the specified parameters
+// Present creates a TXT record using the specified parameters and publishes
+// the zone before returning. Callers that are adding several records at
+// once (e.g. a SAN certificate covering many domains) should use PresentAll
+// instead, which coalesces the publish into one call per zone.
 func (d *DNSProvider) Present(domain, token, keyAuth string) error {
-	fqdn, value, ttl := acme.DNS01Record(domain, keyAuth)
+	if err := d.present(domain, keyAuth); err != nil {
+		return err
+	}
+
+	return d.Commit()
+}
+
+// present adds the TXT record for domain/keyAuth but leaves the zone
+// publish to the caller, so PresentAll can coalesce it across records.
+func (d *DNSProvider) present(domain, keyAuth string) error {
+	fqdn, value, _ := acme.DNS01Record(domain, keyAuth)
 
 	authZone, err := acme.FindZoneByFqdn(fqdn, acme.RecursiveNameservers)
 	if err != nil {
 		return err
 	}
 
-	err = d.login()
-	if err != nil {
+	if err := d.ensureSession(); err != nil {
 		return err
 	}
 
@@ -194,21 +519,29 @@ func (d *DNSProvider) Present(domain, token, keyAuth string) error {
 		"rdata": map[string]string{
 			"txtdata": value,
 		},
-		"ttl": strconv.Itoa(ttl),
+		"ttl": strconv.Itoa(d.config.TTL),
 	}
 
 	resource := fmt.Sprintf("TXTRecord/%s/%s/", authZone, fqdn)
-	_, err = d.sendRequest(http.MethodPost, resource, data)
-	if err != nil {
+	if _, err := d.sendRequest(http.MethodPost, resource, data); err != nil {
 		return err
 	}
 
-	err = d.publish(authZone, "Added TXT record for ACME dns-01 challenge using lego client")
-	if err != nil {
-		return err
+	return d.schedulePublish(authZone)
+}
+
+// PresentAll creates TXT records for every domain/keyAuth pair, reusing a
+// single session and publishing each affected zone once, at the end. If
+// adding the records takes longer than publishDebounceWindow, the debounce
+// timer may also publish a zone before the loop finishes.
+func (d *DNSProvider) PresentAll(records []Record) error {
+	for _, r := range records {
+		if err := d.present(r.Domain, r.KeyAuth); err != nil {
+			return err
+		}
 	}
 
-	return d.logout()
+	return d.Commit()
 }
 
 func (d *DNSProvider) publish(zone, notes string) error {
@@ -217,6 +550,8 @@ func (d *DNSProvider) publish(zone, notes string) error {
 		Notes   string `json:"notes"`
 	}
 
+	log.Infof("dyn: publishing zone %s", zone)
+
 	pub := &publish{Publish: true, Notes: notes}
 	resource := fmt.Sprintf("Zone/%s/", zone)
 
@@ -224,45 +559,191 @@ func (d *DNSProvider) publish(zone, notes string) error {
 	return err
 }
 
-// CleanUp removes the TXT record matching the specified parameters
-func (d *DNSProvider) CleanUp(domain, token, keyAuth string) error {
-	fqdn, _, _ := acme.DNS01Record(domain, keyAuth)
+// schedulePublish marks zone as having pending changes, to be published by
+// the next Commit call (Present/CleanUp call Commit right after each record,
+// PresentAll/CleanUpAll call it once at the end). It also starts the debounce
+// timer if it isn't running, so pending zones are published by flushPending
+// once publishDebounceWindow elapses without a Commit.
+func (d *DNSProvider) schedulePublish(zone string) error {
+	d.pendingMu.Lock()
+	defer d.pendingMu.Unlock()
+
+	if d.pendingZones == nil {
+		d.pendingZones = make(map[string]struct{})
+	}
+	d.pendingZones[zone] = struct{}{}
 
-	authZone, err := acme.FindZoneByFqdn(fqdn, acme.RecursiveNameservers)
-	if err != nil {
+	if d.flushTimer == nil {
+		d.flushTimer = time.AfterFunc(publishDebounceWindow, d.flushPending)
+	}
+
+	// Surface a failure from an earlier deferred flush of this same zone, if
+	// any; zone itself is still tracked above and will be retried on the
+	// next flush/Commit. Other zones' failures are unaffected.
+	if err, ok := d.flushErrs[zone]; ok {
+		delete(d.flushErrs, zone)
 		return err
 	}
 
-	err = d.login()
-	if err != nil {
+	return nil
+}
+
+// popPendingZones detaches the current set of pending zones and stops the
+// debounce timer, so the caller can publish them without racing a
+// concurrent schedulePublish/Commit.
+func (d *DNSProvider) popPendingZones() map[string]struct{} {
+	d.pendingMu.Lock()
+	defer d.pendingMu.Unlock()
+
+	zones := d.pendingZones
+	d.pendingZones = nil
+	if d.flushTimer != nil {
+		d.flushTimer.Stop()
+		d.flushTimer = nil
+	}
+
+	return zones
+}
+
+// requeueZones re-marks zones as pending (e.g. after a failed publish) and
+// restarts the debounce timer if it isn't already running.
+func (d *DNSProvider) requeueZones(zones map[string]struct{}) {
+	d.pendingMu.Lock()
+	defer d.pendingMu.Unlock()
+
+	if d.pendingZones == nil {
+		d.pendingZones = make(map[string]struct{})
+	}
+	for zone := range zones {
+		d.pendingZones[zone] = struct{}{}
+	}
+	if d.flushTimer == nil {
+		d.flushTimer = time.AfterFunc(publishDebounceWindow, d.flushPending)
+	}
+}
+
+// flushPending is invoked by the debounce timer when no explicit Commit
+// happened in time; a zone's failure is surfaced to its own next
+// schedulePublish call, without affecting unrelated zones.
+func (d *DNSProvider) flushPending() {
+	zones := d.popPendingZones()
+
+	failed := make(map[string]struct{})
+	for zone := range zones {
+		notes := "Updated TXT records for ACME dns-01 challenge using lego client"
+		if err := d.publish(zone, notes); err != nil {
+			log.Warnf("dyn: deferred publish of zone %s failed, will be reported on its next call: %v", zone, err)
+			failed[zone] = struct{}{}
+
+			d.pendingMu.Lock()
+			if d.flushErrs == nil {
+				d.flushErrs = make(map[string]error)
+			}
+			d.flushErrs[zone] = err
+			d.pendingMu.Unlock()
+		}
+	}
+
+	if len(failed) > 0 {
+		d.requeueZones(failed)
+	}
+}
+
+// Commit publishes every zone with pending TXT record changes, coalescing
+// them into a single publish per zone. It is safe to call with nothing
+// pending. Zones whose publish fails are kept pending so a later Commit, or
+// the debounce timer, retries them instead of losing them.
+func (d *DNSProvider) Commit() error {
+	zones := d.popPendingZones()
+
+	var failedZones, messages []string
+	failed := make(map[string]struct{})
+	for zone := range zones {
+		if err := d.publish(zone, "Updated TXT records for ACME dns-01 challenge using lego client"); err != nil {
+			failedZones = append(failedZones, zone)
+			messages = append(messages, fmt.Sprintf("%s: %v", zone, err))
+			failed[zone] = struct{}{}
+		}
+	}
+
+	if len(failedZones) > 0 {
+		d.requeueZones(failed)
+
+		return fmt.Errorf("Dyn API failed to publish %d zone(s): %s", len(failedZones), strings.Join(messages, "; "))
+	}
+
+	return nil
+}
+
+// CleanUp removes the TXT record matching the specified parameters,
+// publishes the zone, and closes the Dyn session - lego calls CleanUp once
+// per domain as the last step of a DNS-01 challenge, so this is where the
+// session opened by ensureSession is released. As with Present, callers
+// removing several records at once should use CleanUpAll instead.
+func (d *DNSProvider) CleanUp(domain, token, keyAuth string) error {
+	if err := d.cleanUp(domain, keyAuth); err != nil {
 		return err
 	}
 
-	resource := fmt.Sprintf("TXTRecord/%s/%s/", authZone, fqdn)
-	url := fmt.Sprintf("%s/%s", dynBaseURL, resource)
+	if err := d.Commit(); err != nil {
+		return err
+	}
 
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	d.closeSession()
+
+	return nil
+}
+
+// closeSession ends the cached Dyn session and only logs a warning on
+// failure, since the TXT record change it's guarding has already been
+// published successfully by this point.
+func (d *DNSProvider) closeSession() {
+	if err := d.Close(); err != nil {
+		log.Warnf("dyn: failed to close session: %v", err)
+	}
+}
+
+// cleanUp removes the TXT record for domain/keyAuth but leaves the zone
+// publish to the caller, so CleanUpAll can coalesce it across records.
+func (d *DNSProvider) cleanUp(domain, keyAuth string) error {
+	fqdn, _, _ := acme.DNS01Record(domain, keyAuth)
+
+	authZone, err := acme.FindZoneByFqdn(fqdn, acme.RecursiveNameservers)
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Auth-Token", d.token)
+	if err := d.ensureSession(); err != nil {
+		return err
+	}
 
-	resp, err := d.client.Do(req)
-	if err != nil {
+	log.Infof("dyn: removing TXT record for %s", fqdn)
+
+	resource := fmt.Sprintf("TXTRecord/%s/%s/", authZone, fqdn)
+	if _, err := d.sendRequest(http.MethodDelete, resource, nil); err != nil {
 		return err
 	}
-	resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("Dyn API request failed to delete TXT record HTTP status code %d", resp.StatusCode)
+	return d.schedulePublish(authZone)
+}
+
+// CleanUpAll removes TXT records for every domain/keyAuth pair, reusing a
+// single session, publishing each affected zone once at the end, and closing
+// the session once every record has been removed. As with PresentAll, the
+// debounce timer may also publish a zone earlier if removing the records
+// takes longer than publishDebounceWindow.
+func (d *DNSProvider) CleanUpAll(records []Record) error {
+	for _, r := range records {
+		if err := d.cleanUp(r.Domain, r.KeyAuth); err != nil {
+			return err
+		}
 	}
 
-	err = d.publish(authZone, "Removed TXT record for ACME dns-01 challenge using lego client")
-	if err != nil {
+	if err := d.Commit(); err != nil {
 		return err
 	}
 
-	return d.logout()
+	d.closeSession()
+
+	return nil
 }
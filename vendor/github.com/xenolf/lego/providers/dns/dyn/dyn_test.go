@@ -0,0 +1,407 @@
+package dyn
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestProvider(t *testing.T, handler http.Handler) *DNSProvider {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	restore := dynBaseURL
+	dynBaseURL = server.URL
+	t.Cleanup(func() { dynBaseURL = restore })
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	preventRedirectFollowing(client)
+
+	return &DNSProvider{
+		config: &Config{
+			CustomerName:   "customer",
+			UserName:       "user",
+			Password:       "pass",
+			TTL:            defaultTTL,
+			JobPollTimeout: 5 * time.Second,
+			HTTPClient:     client,
+		},
+	}
+}
+
+// TestSendRequestPollsJobOn307 proves a 307 response drives an explicit GET
+// to the Job resource instead of being transparently re-sent by the HTTP
+// client as a second POST of the original payload.
+func TestSendRequestPollsJobOn307(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/TXTRecord/example.com/_acme-challenge.example.com./", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+
+		w.Header().Set("Location", "/REST/Job/42")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+		json.NewEncoder(w).Encode(dynResponse{Status: "incomplete", JobID: 42})
+	})
+	mux.HandleFunc("/Job/42", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+
+	_, err := provider.sendRequest(http.MethodPost, "TXTRecord/example.com/_acme-challenge.example.com./", map[string]string{"k": "v"})
+	if err != nil {
+		t.Fatalf("sendRequest returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(methods) != 2 {
+		t.Fatalf("expected 2 requests (initial + job poll), got %d: %v", len(methods), methods)
+	}
+	if methods[0] != http.MethodPost {
+		t.Errorf("expected initial request to stay a POST, got %s", methods[0])
+	}
+	if methods[1] != http.MethodGet {
+		t.Errorf("expected the job to be polled with GET, got %s", methods[1])
+	}
+}
+
+// TestNewDNSProviderConfigAppliesHTTPTimeout proves Config.HTTPTimeout is
+// applied to the HTTP client's Timeout regardless of who built the client.
+func TestNewDNSProviderConfigAppliesHTTPTimeout(t *testing.T) {
+	config := &Config{
+		CustomerName: "customer",
+		UserName:     "user",
+		Password:     "pass",
+		HTTPTimeout:  42 * time.Second,
+		HTTPClient:   &http.Client{Timeout: 7 * time.Second},
+	}
+
+	provider, err := NewDNSProviderConfig(config)
+	if err != nil {
+		t.Fatalf("NewDNSProviderConfig returned error: %v", err)
+	}
+
+	if provider.config.HTTPClient.Timeout != 42*time.Second {
+		t.Fatalf("expected HTTPTimeout to override the supplied client's Timeout, got %s", provider.config.HTTPClient.Timeout)
+	}
+}
+
+// TestPollJobReauthenticatesOnStaleToken proves pollJob re-authenticates
+// rather than hammering the Job resource with an expired token until it
+// times out with a misleading "did not complete" error.
+func TestPollJobReauthenticatesOnStaleToken(t *testing.T) {
+	var mu sync.Mutex
+	var sessionLogins int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Session", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sessionLogins++
+		mu.Unlock()
+
+		data, _ := json.Marshal(map[string]string{"token": "fresh-token"})
+		json.NewEncoder(w).Encode(dynResponse{Status: "success", Data: data})
+	})
+	mux.HandleFunc("/Job/42", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Auth-Token") == "stale-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(dynResponse{Status: "failure"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+	provider.setToken("stale-token")
+
+	if _, err := provider.pollJob(42); err != nil {
+		t.Fatalf("pollJob returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sessionLogins != 1 {
+		t.Fatalf("expected exactly 1 re-login after the stale-token 401, got %d", sessionLogins)
+	}
+}
+
+// TestSendRequestReauthenticatesOn401 proves a stale cached session token is
+// dropped and replaced by a single re-login, rather than failing outright.
+func TestSendRequestReauthenticatesOn401(t *testing.T) {
+	var mu sync.Mutex
+	var sessionLogins int
+	var sawFreshToken bool
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Session", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		sessionLogins++
+		mu.Unlock()
+
+		data, _ := json.Marshal(map[string]string{"token": "fresh-token"})
+		json.NewEncoder(w).Encode(dynResponse{Status: "success", Data: data})
+	})
+	mux.HandleFunc("/Zone/example.com/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("Auth-Token") == "stale-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(dynResponse{Status: "failure"})
+			return
+		}
+
+		sawFreshToken = r.Header.Get("Auth-Token") == "fresh-token"
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+	provider.setToken("stale-token")
+
+	if err := provider.publish("example.com", "test"); err != nil {
+		t.Fatalf("publish returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if sessionLogins != 1 {
+		t.Fatalf("expected exactly 1 re-login after the 401, got %d", sessionLogins)
+	}
+	if !sawFreshToken {
+		t.Fatalf("expected the retried request to carry the freshly issued token")
+	}
+}
+
+// TestSendRequestFailsOnPersistentUnauthorized proves a 401 that survives
+// re-authentication is a hard error, even if the decoded body doesn't carry
+// "status":"failure".
+func TestSendRequestFailsOnPersistentUnauthorized(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Session", func(w http.ResponseWriter, r *http.Request) {
+		data, _ := json.Marshal(map[string]string{"token": "still-bad-token"})
+		json.NewEncoder(w).Encode(dynResponse{Status: "success", Data: data})
+	})
+	mux.HandleFunc("/Zone/example.com/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+	provider.setToken("bad-token")
+
+	if err := provider.publish("example.com", "test"); err == nil {
+		t.Fatalf("expected publish to fail when the retried request is still unauthorized")
+	}
+}
+
+// TestCommitCoalescesPendingZonePublishes proves that scheduling several
+// changes against the same zone results in a single publish, matching the
+// batching PresentAll/CleanUpAll are meant to provide.
+func TestCommitCoalescesPendingZonePublishes(t *testing.T) {
+	var mu sync.Mutex
+	publishes := map[string]int{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Zone/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		publishes[r.URL.Path]++
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+
+	for i := 0; i < 3; i++ {
+		if err := provider.schedulePublish("zone-a.com"); err != nil {
+			t.Fatalf("schedulePublish(zone-a.com) returned error: %v", err)
+		}
+	}
+	if err := provider.schedulePublish("zone-b.com"); err != nil {
+		t.Fatalf("schedulePublish(zone-b.com) returned error: %v", err)
+	}
+
+	if err := provider.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if publishes["/Zone/zone-a.com/"] != 1 {
+		t.Errorf("expected exactly 1 publish for zone-a.com, got %d", publishes["/Zone/zone-a.com/"])
+	}
+	if publishes["/Zone/zone-b.com/"] != 1 {
+		t.Errorf("expected exactly 1 publish for zone-b.com, got %d", publishes["/Zone/zone-b.com/"])
+	}
+}
+
+// TestCloseSessionEndsSessionAndIgnoresFailure proves closeSession (used by
+// CleanUp/CleanUpAll to avoid leaking an open Dyn session) deletes the
+// cached session and doesn't propagate a failure to the caller, since the
+// TXT record change it guards has already been published by that point.
+func TestCloseSessionEndsSessionAndIgnoresFailure(t *testing.T) {
+	var mu sync.Mutex
+	deletes := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Session", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Fatalf("unexpected method %s on /Session", r.Method)
+		}
+		mu.Lock()
+		deletes++
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	provider := newTestProvider(t, mux)
+	provider.setToken("a-token")
+
+	provider.closeSession()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if deletes != 1 {
+		t.Fatalf("expected exactly 1 DELETE /Session, got %d", deletes)
+	}
+}
+
+// TestCommitPublishesImmediatelyAndStopsDebounceTimer proves the
+// schedulePublish+Commit sequence Present/CleanUp now use publishes the
+// zone synchronously, exactly once, with no further publish coming later
+// from the debounce timer (which Present/CleanUp used to leave running).
+func TestCommitPublishesImmediatelyAndStopsDebounceTimer(t *testing.T) {
+	var mu sync.Mutex
+	publishes := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Zone/example.com/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		publishes++
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+
+	if err := provider.schedulePublish("example.com"); err != nil {
+		t.Fatalf("schedulePublish returned error: %v", err)
+	}
+	if err := provider.Commit(); err != nil {
+		t.Fatalf("Commit returned error: %v", err)
+	}
+
+	mu.Lock()
+	if publishes != 1 {
+		mu.Unlock()
+		t.Fatalf("expected exactly 1 publish right after Commit, got %d", publishes)
+	}
+	mu.Unlock()
+
+	time.Sleep(publishDebounceWindow + 500*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if publishes != 1 {
+		t.Fatalf("expected the debounce timer not to fire a second publish, got %d total", publishes)
+	}
+}
+
+// TestCommitRetainsFailedZonesForRetry proves a zone whose publish fails
+// stays pending instead of being silently dropped.
+func TestCommitRetainsFailedZonesForRetry(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Zone/flaky.com/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		n := attempts
+		mu.Unlock()
+
+		if n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(dynResponse{Status: "failure"})
+			return
+		}
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+
+	if err := provider.schedulePublish("flaky.com"); err != nil {
+		t.Fatalf("schedulePublish returned error: %v", err)
+	}
+
+	if err := provider.Commit(); err == nil {
+		t.Fatalf("expected the first Commit to surface the publish failure")
+	}
+
+	if err := provider.Commit(); err != nil {
+		t.Fatalf("expected the retried Commit to succeed, got: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if attempts != 2 {
+		t.Fatalf("expected exactly 2 publish attempts for flaky.com, got %d", attempts)
+	}
+}
+
+// TestFlushErrIsScopedPerZone proves a deferred flush failure for one zone
+// is only surfaced on that zone's next schedulePublish call, not on an
+// unrelated zone's.
+func TestFlushErrIsScopedPerZone(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/Zone/failing.com/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(dynResponse{Status: "failure"})
+	})
+	mux.HandleFunc("/Zone/unrelated.com/", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(dynResponse{Status: "success"})
+	})
+
+	provider := newTestProvider(t, mux)
+	// requeueZones restarts the debounce timer on every failure; drain it at
+	// the end so no background publish outlives this test.
+	t.Cleanup(func() { provider.popPendingZones() })
+
+	if err := provider.schedulePublish("failing.com"); err != nil {
+		t.Fatalf("schedulePublish(failing.com) returned error: %v", err)
+	}
+
+	// Simulate the debounce timer firing before an explicit Commit, for a
+	// zone whose publish fails.
+	provider.flushPending()
+
+	if err := provider.schedulePublish("unrelated.com"); err != nil {
+		t.Fatalf("schedulePublish(unrelated.com) should not surface failing.com's stale error, got: %v", err)
+	}
+
+	err := provider.schedulePublish("failing.com")
+	if err == nil {
+		t.Fatalf("expected schedulePublish(failing.com) to surface its own deferred flush error")
+	}
+}